@@ -13,10 +13,6 @@ import (
 	"time"
 
 	"github.com/ip2location/ip2location-go/v9"
-	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwe"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
 type AddIdentityEmailHandler struct {
@@ -45,24 +41,6 @@ func NewAddIdentityEmailHandler(db Database, cluster *Cluster, tmpl *template.Te
 		pendingLogins: make(map[string]*PendingLogin),
 	}
 
-	privateJwks, err := GetJWKS(db)
-	checkErr(err)
-
-	publicJwks, err := jwk.PublicSetOf(privateJwks)
-	checkErr(err)
-
-	privKey, exists := privateJwks.Key(0)
-	if !exists {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	pubKey, exists := publicJwks.Key(0)
-	if !exists {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
 	const EmailTimeout = 5 * time.Minute
 	prefix, err := db.GetPrefix()
 	checkErr(err)
@@ -173,10 +151,7 @@ func NewAddIdentityEmailHandler(db Database, cluster *Cluster, tmpl *template.Te
 
 		// TODO: now that we're using magic links instead of codes,
 		// does it still add value for this to be encrypted?
-		encryptedJwt, err := NewJWTSerializer().
-			Sign(jwt.WithKey(jwa.RS256, privKey)).
-			Encrypt(jwt.WithKey(jwa.RSA_OAEP_256, pubKey)).
-			Serialize(emailCodeJwt)
+		encryptedJwt, err := SignAndEncryptJWT(db, emailCodeJwt)
 		if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
@@ -323,8 +298,7 @@ func NewAddIdentityEmailHandler(db Database, cluster *Cluster, tmpl *template.Te
 
 		emailCodeJwtCookie, err := r.Cookie(prefix + "email_login")
 		if err == nil {
-			encryptedJwt := []byte(emailCodeJwtCookie.Value)
-			decryptedJwt, err := jwe.Decrypt(encryptedJwt, jwe.WithKey(jwa.RSA_OAEP_256, privKey))
+			decryptedJwt, err := DecryptJWT(db, emailCodeJwtCookie.Value)
 			if err != nil {
 				w.WriteHeader(500)
 				io.WriteString(w, err.Error())
@@ -52,7 +52,7 @@ func buildProviderLogoMap(db Database) {
 	}
 }
 
-func NewAddIdentityOauth2Handler(db Database, oauth2MetaMan *OAuth2MetadataManager, jose *JOSE) *AddIdentityOauth2Handler {
+func NewAddIdentityOauth2Handler(db Database, oauth2MetaMan *OAuth2MetadataManager, behindProxy bool, jose *JOSE, eventWebhook *EventWebhook) *AddIdentityOauth2Handler {
 	mux := http.NewServeMux()
 
 	h := &AddIdentityOauth2Handler{
@@ -367,6 +367,14 @@ func NewAddIdentityOauth2Handler(db Database, oauth2MetaMan *OAuth2MetadataManag
 		clearCookie(r.Host, prefix+"upstream_oauth2_request", w)
 
 		http.Redirect(w, r, redirUrl, http.StatusSeeOther)
+
+		eventWebhook.SendLoginEvent(&LoginEvent{
+			Type:         EventTypeAddIdentity,
+			Subject:      email,
+			Email:        email,
+			ProviderName: oauth2Provider.Name,
+			RemoteIp:     getEventRemoteIp(r, behindProxy),
+		})
 	})
 
 	return h
@@ -397,6 +405,37 @@ func GeneratePKCECodeChallenge(verifier string) string {
 	return base64.RawURLEncoding.EncodeToString(sha2.Sum(nil))
 }
 
+// Checks a PKCE code_verifier against the code_challenge using the given
+// code_challenge_method. Codes issued before the method was recorded don't
+// have one, and were always S256.
+func VerifyPKCECodeVerifier(challenge, method, verifier string) bool {
+	switch method {
+	case "plain":
+		return verifier == challenge
+	case "S256", "":
+		return GeneratePKCECodeChallenge(verifier) == challenge
+	}
+	return false
+}
+
+// RFC 7636 4.1 and 4.2. This matters most for plain, where the challenge is
+// the verifier.
+func ValidPKCECodeChallenge(challenge string) bool {
+	if len(challenge) < 43 || len(challenge) > 128 {
+		return false
+	}
+
+	for _, c := range challenge {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || strings.ContainsRune("-._~", c)
+		if !valid {
+			return false
+		}
+	}
+
+	return true
+}
+
 func GeneratePKCEData() (string, string, error) {
 
 	verifier, err := GeneratePKCECodeVerifier()
@@ -0,0 +1,66 @@
+package obligator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCECodeVerifier(t *testing.T) {
+	verifier, err := GeneratePKCECodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s256Challenge := GeneratePKCECodeChallenge(verifier)
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		valid     bool
+	}{
+		{"S256", s256Challenge, "S256", verifier, true},
+		{"S256 wrong verifier", s256Challenge, "S256", verifier + "x", false},
+		{"legacy empty method is S256", s256Challenge, "", verifier, true},
+		{"plain", verifier, "plain", verifier, true},
+		{"plain wrong verifier", verifier, "plain", verifier + "x", false},
+		// Presenting the challenge itself only works if plain was recorded
+		{"S256 downgrade to plain", s256Challenge, "S256", s256Challenge, false},
+		{"unknown method", verifier, "S512", verifier, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid := VerifyPKCECodeVerifier(test.challenge, test.method, test.verifier)
+			if valid != test.valid {
+				t.Fatalf("expected %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestValidPKCECodeChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		valid     bool
+	}{
+		{"S256 challenge", GeneratePKCECodeChallenge("verifier"), true},
+		{"min length", strings.Repeat("a", 43), true},
+		{"max length", strings.Repeat("a", 128), true},
+		{"all allowed characters", "abcXYZ0129-._~" + strings.Repeat("a", 30), true},
+		{"too short", strings.Repeat("a", 42), false},
+		{"too long", strings.Repeat("a", 129), false},
+		{"invalid character", strings.Repeat("a", 42) + "+", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid := ValidPKCECodeChallenge(test.challenge)
+			if valid != test.valid {
+				t.Fatalf("expected %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,15 +16,17 @@ import (
 type Api struct {
 	db            Database
 	oauth2MetaMan *OAuth2MetadataManager
+	jose          *JOSE
 }
 
-func NewApi(db Database, dir string, oauth2MetaMan *OAuth2MetadataManager) (*Api, error) {
+func NewApi(db Database, dir string, oauth2MetaMan *OAuth2MetadataManager, jose *JOSE) (*Api, error) {
 
 	mux := http.NewServeMux()
 
 	a := &Api{
 		db,
 		oauth2MetaMan,
+		jose,
 	}
 
 	if dir == "" {
@@ -110,6 +113,58 @@ func NewApi(db Database, dir string, oauth2MetaMan *OAuth2MetadataManager) (*Api
 		}
 	})
 
+	mux.HandleFunc("/oauth2-clients", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			clients, err := a.GetOAuth2Clients()
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			json.NewEncoder(w).Encode(clients)
+		case "POST":
+			var client OAuth2Client
+			err := json.NewDecoder(r.Body).Decode(&client)
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			err = a.SetOAuth2Client(&client)
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, err.Error())
+				return
+			}
+		case "DELETE":
+			err := a.DeleteOAuth2Client(r.URL.Query().Get("client_id"))
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(405)
+		}
+	})
+
+	mux.HandleFunc("/signing-keys", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			err := a.RotateSigningKey()
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(405)
+		}
+	})
+
 	server := http.Server{
 		Handler: mux,
 	}
@@ -181,3 +236,54 @@ func (a *Api) AddUser(user User) error {
 func (a *Api) GetUsers() ([]*User, error) {
 	return a.db.GetUsers()
 }
+
+func (a *Api) RotateSigningKey() error {
+	return a.jose.RotateSigningKey()
+}
+
+func (a *Api) GetOAuth2Clients() ([]*OAuth2Client, error) {
+	return a.db.GetOAuth2Clients()
+}
+
+// Replaces any existing registration for the client, so can be used to undo
+// a bogus dynamic registration.
+func (a *Api) SetOAuth2Client(client *OAuth2Client) error {
+	if len(client.RedirectUris) == 0 {
+		return errors.New("Missing redirect_uris")
+	}
+
+	var clientId string
+	for _, redirectUri := range client.RedirectUris {
+		parsedRedirectUri, err := url.Parse(redirectUri)
+		if err != nil {
+			return err
+		}
+
+		if parsedRedirectUri.Host == "" {
+			return errors.New("redirect_uris must be absolute URIs with a host")
+		}
+
+		redirectClientId := clientIdForHost(parsedRedirectUri.Host)
+		if clientId == "" {
+			clientId = redirectClientId
+		} else if redirectClientId != clientId {
+			return errors.New("All redirect_uris must be on the same domain")
+		}
+	}
+
+	if client.ClientId != "" && client.ClientId != clientId {
+		return errors.New("client_id must match the domain of redirect_uris")
+	}
+
+	client.ClientId = clientId
+
+	return a.db.SetOAuth2Client(client)
+}
+
+func (a *Api) DeleteOAuth2Client(clientId string) error {
+	if clientId == "" {
+		return errors.New("Missing client_id")
+	}
+
+	return a.db.DeleteOAuth2Client(clientId)
+}
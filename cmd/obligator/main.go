@@ -71,6 +71,11 @@ func main() {
 		if config.Users != nil {
 			conf.Users = config.Users
 		}
+		if config.CorsAllowedOrigins != nil {
+			conf.CorsAllowedOrigins = config.CorsAllowedOrigins
+		}
+		conf.EventWebhookURL = config.EventWebhookURL
+		conf.PersistDynamicClients = config.PersistDynamicClients
 		conf.Public = config.Public
 	}
 
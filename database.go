@@ -18,12 +18,18 @@ type Database interface {
 	SetPublic(public bool) error
 	GetJwksJson() (string, error)
 	SetJwksJson(jwksJson string) error
+	GetSigningKeyId() (string, error)
+	SetSigningKeyId(kid string) error
 	GetForwardAuthPassthrough() (bool, error)
 	GetPrefix() (string, error)
 	SetPrefix(value string) error
 	GetOAuth2Providers() ([]*OAuth2Provider, error)
 	GetOAuth2ProviderByID(id string) (*OAuth2Provider, error)
 	SetOAuth2Provider(p *OAuth2Provider) error
+	GetOAuth2Clients() ([]*OAuth2Client, error)
+	GetOAuth2Client(clientId string) (*OAuth2Client, error)
+	SetOAuth2Client(c *OAuth2Client) error
+	DeleteOAuth2Client(clientId string) error
 	GetSmtpConfig() (*SmtpConfig, error)
 	SetSmtpConfig(smtp *SmtpConfig) error
 	GetUsers() ([]*User, error)
@@ -48,6 +54,11 @@ type OAuth2Provider struct {
 	OpenIDConnect    bool   `json:"openid_connect" db:"supports_openid_connect"`
 }
 
+type OAuth2Client struct {
+	ClientId     string   `json:"client_id"`
+	RedirectUris []string `json:"redirect_uris"`
+}
+
 type User struct {
 	IdType string `json:"id_type" db:"id_type"`
 	Id     string `json:"email" db:"id"`
@@ -109,6 +120,16 @@ func NewSqliteDatabaseWithDb(sqlDb *sql.DB, prefix string) (*SqliteDatabase, err
 		}
 	}
 
+	stmt = fmt.Sprintf(`
+        ALTER TABLE %sconfig ADD COLUMN signing_key_id TEXT DEFAULT "" NOT NULL;
+        `, prefix)
+	_, err = db.Exec(stmt)
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		if sqliteErr.Code != sqlite3.ErrError {
+			return nil, err
+		}
+	}
+
 	stmt = fmt.Sprintf(`
         create table %semail_validation_requests(id integer not null primary key, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP, hashed_requester_id TEXT NOT NULL, hashed_email TEXT NOT NULL);
         `, prefix)
@@ -159,6 +180,17 @@ func NewSqliteDatabaseWithDb(sqlDb *sql.DB, prefix string) (*SqliteDatabase, err
 		return nil, err
 	}
 
+	stmt = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %soauth2_clients(
+                client_id TEXT PRIMARY KEY,
+                redirect_uris_json TEXT NOT NULL
+        );
+        `, prefix)
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &SqliteDatabase{
 		db:     db,
 		prefix: prefix,
@@ -206,6 +238,33 @@ func (d *SqliteDatabase) SetJwksJson(jwksJson string) error {
 	return nil
 }
 
+func (d *SqliteDatabase) GetSigningKeyId() (string, error) {
+	var kid string
+
+	stmt := fmt.Sprintf(`
+        SELECT signing_key_id FROM %sconfig;
+        `, d.prefix)
+	err := d.db.QueryRow(stmt).Scan(&kid)
+	if err != nil {
+		return "", err
+	}
+
+	return kid, nil
+}
+
+func (d *SqliteDatabase) SetSigningKeyId(kid string) error {
+
+	stmt := fmt.Sprintf(`
+        UPDATE %sconfig SET signing_key_id=?;
+        `, d.prefix)
+	_, err := d.db.Exec(stmt, kid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (d *SqliteDatabase) GetSmtpConfig() (*SmtpConfig, error) {
 	var smtpJson *string
 
@@ -505,3 +564,93 @@ func (d *SqliteDatabase) SetOAuth2Provider(p *OAuth2Provider) error {
 
 	return nil
 }
+
+func (d *SqliteDatabase) GetOAuth2Clients() ([]*OAuth2Client, error) {
+
+	stmt := fmt.Sprintf(`
+        SELECT client_id,redirect_uris_json FROM %soauth2_clients;
+        `, d.prefix)
+	rows, err := d.db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuth2Client{}
+
+	for rows.Next() {
+		var c OAuth2Client
+		var redirectUrisJson string
+		err = rows.Scan(&c.ClientId, &redirectUrisJson)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(redirectUrisJson), &c.RedirectUris)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, &c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (d *SqliteDatabase) GetOAuth2Client(clientId string) (*OAuth2Client, error) {
+
+	var redirectUrisJson string
+
+	stmt := fmt.Sprintf(`
+        SELECT redirect_uris_json FROM %soauth2_clients WHERE client_id = ?;
+        `, d.prefix)
+	err := d.db.QueryRow(stmt, clientId).Scan(&redirectUrisJson)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &OAuth2Client{
+		ClientId: clientId,
+	}
+
+	err = json.Unmarshal([]byte(redirectUrisJson), &c.RedirectUris)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (d *SqliteDatabase) SetOAuth2Client(c *OAuth2Client) error {
+
+	redirectUrisJson, err := json.Marshal(c.RedirectUris)
+	if err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf(`
+        INSERT OR REPLACE INTO %soauth2_clients(client_id,redirect_uris_json) VALUES(?,?);
+        `, d.prefix)
+	_, err = d.db.Exec(stmt, c.ClientId, string(redirectUrisJson))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteOAuth2Client(clientId string) error {
+	stmt := fmt.Sprintf(`
+        DELETE FROM %soauth2_clients WHERE client_id = ?;
+        `, d.prefix)
+	_, err := d.db.Exec(stmt, clientId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package obligator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const EventTypeLogin = "login"
+const EventTypeAddIdentity = "add_identity"
+
+type LoginEvent struct {
+	Type         string `json:"type"`
+	Subject      string `json:"subject"`
+	Email        string `json:"email"`
+	ClientId     string `json:"client_id,omitempty"`
+	ProviderName string `json:"provider_name"`
+	Timestamp    string `json:"timestamp"`
+	RemoteIp     string `json:"remote_ip"`
+}
+
+type EventWebhook struct {
+	uri         string
+	httpClient  *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+	events      chan []byte
+}
+
+func NewEventWebhook(uri string) *EventWebhook {
+	return newEventWebhook(uri, 3, 2*time.Second, 256)
+}
+
+func newEventWebhook(uri string, maxAttempts int, retryDelay time.Duration, queueSize int) *EventWebhook {
+	h := &EventWebhook{
+		uri: uri,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+		events:      make(chan []byte, queueSize),
+	}
+
+	if uri != "" {
+		go h.run()
+	}
+
+	return h
+}
+
+// Delivery happens in the background and failures are only logged, so a
+// broken webhook endpoint never affects logins. If the queue is full the
+// event is dropped.
+func (h *EventWebhook) SendLoginEvent(event *LoginEvent) {
+	if h == nil || h.uri == "" {
+		return
+	}
+
+	if event.Timestamp == "" {
+		event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+
+	select {
+	case h.events <- body:
+	default:
+		fmt.Fprintf(os.Stderr, "Event webhook queue full, dropping %s event for %s\n", event.Type, event.Subject)
+	}
+}
+
+func (h *EventWebhook) run() {
+	for body := range h.events {
+		for attempt := 1; attempt <= h.maxAttempts; attempt++ {
+			err := h.post(body)
+			if err == nil {
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "Event webhook attempt %d failed: %s\n", attempt, err.Error())
+
+			if attempt < h.maxAttempts {
+				time.Sleep(h.retryDelay * time.Duration(attempt))
+			}
+		}
+	}
+}
+
+func (h *EventWebhook) post(body []byte) error {
+	resp, err := h.httpClient.Post(h.uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Invalid status %d", resp.StatusCode)
+	}
+
+	return nil
+}
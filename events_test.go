@@ -0,0 +1,137 @@
+package obligator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventWebhookPayloadAndRetry(t *testing.T) {
+	var attempts int32
+	payloads := make(chan map[string]interface{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected application/json, got %s", r.Header.Get("Content-Type"))
+		}
+
+		var payload map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			t.Error(err)
+		}
+
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	webhook := newEventWebhook(server.URL, 3, time.Millisecond, 1)
+
+	webhook.SendLoginEvent(&LoginEvent{
+		Type:         EventTypeLogin,
+		Subject:      "user@example.com",
+		Email:        "user@example.com",
+		ClientId:     "https://app.example.com",
+		ProviderName: "Email",
+		Timestamp:    "2024-01-01T00:00:00Z",
+		RemoteIp:     "203.0.113.5",
+	})
+
+	var payload map[string]interface{}
+	select {
+	case payload = <-payloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("expected a retry after the 500, got %d attempts", atomic.LoadInt32(&attempts))
+	}
+
+	expected := map[string]interface{}{
+		"type":          "login",
+		"subject":       "user@example.com",
+		"email":         "user@example.com",
+		"client_id":     "https://app.example.com",
+		"provider_name": "Email",
+		"timestamp":     "2024-01-01T00:00:00Z",
+		"remote_ip":     "203.0.113.5",
+	}
+
+	if len(payload) != len(expected) {
+		t.Fatalf("expected %d fields, got %v", len(expected), payload)
+	}
+
+	for key, value := range expected {
+		if payload[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, payload[key])
+		}
+	}
+}
+
+func TestEventWebhookDisabled(t *testing.T) {
+	var webhook *EventWebhook
+	webhook.SendLoginEvent(&LoginEvent{})
+
+	NewEventWebhook("").SendLoginEvent(&LoginEvent{})
+}
+
+func TestEventWebhookDropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event LoginEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Error(err)
+		}
+
+		received <- event.Subject
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	webhook := newEventWebhook(server.URL, 1, time.Millisecond, 1)
+
+	// Picked up by the worker, which then blocks in the handler
+	webhook.SendLoginEvent(&LoginEvent{Subject: "first"})
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+
+	// Fills the queue
+	webhook.SendLoginEvent(&LoginEvent{Subject: "second"})
+
+	done := make(chan struct{})
+	go func() {
+		webhook.SendLoginEvent(&LoginEvent{Subject: "third"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendLoginEvent blocked on a full queue")
+	}
+
+	if len(webhook.events) != 1 {
+		t.Fatalf("expected 1 queued event, got %d", len(webhook.events))
+	}
+}
@@ -27,7 +27,7 @@ type IndieAuthProfile struct {
 	Email string `json:"email"`
 }
 
-func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jose *JOSE) *IndieAuthHandler {
+func NewIndieAuthHandler(db Database, config ServerConfig, tmpl *template.Template, prefix string, jose *JOSE) *IndieAuthHandler {
 
 	mux := http.NewServeMux()
 
@@ -61,31 +61,13 @@ func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jo
 			return
 		}
 
-		pkceCodeChallenge, exists := parsedCodeJwt.Get("pkce_code_challenge")
-		if !exists {
-			w.WriteHeader(401)
-			io.WriteString(w, "Invalid pkce_code_challenge in code")
+		status, msg := verifyPKCE(parsedCodeJwt, r)
+		if status != 0 {
+			w.WriteHeader(status)
+			io.WriteString(w, msg)
 			return
 		}
 
-		// https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#section-4.8.2
-		// draft-ietf-oauth-security-topics-24 2.1.1
-		pkceCodeVerifier := r.Form.Get("code_verifier")
-		if pkceCodeChallenge != "" {
-			challenge := GeneratePKCECodeChallenge(pkceCodeVerifier)
-			if challenge != pkceCodeChallenge {
-				w.WriteHeader(401)
-				io.WriteString(w, "Invalid code_verifier")
-				return
-			}
-		} else {
-			if pkceCodeVerifier != "" {
-				w.WriteHeader(401)
-				io.WriteString(w, "code_verifier provided for request that did not include code_challenge")
-				return
-			}
-		}
-
 		url := fmt.Sprintf("https://%s/u/%s", r.Host, id)
 
 		response := IndieAuthResponse{
@@ -115,11 +97,19 @@ func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jo
 			return
 		}
 
-		ar, err := ParseAuthRequest(w, r)
+		ar, err := ParseAuthRequest(db, w, r)
 		if err != nil {
 			return
 		}
 
+		// IndieAuth codes are only ever returned as query parameters
+		if ar.ResponseMode != "query" {
+			errUrl := fmt.Sprintf("%s?error=invalid_request&state=%s",
+				ar.RedirectUri, ar.State)
+			http.Redirect(w, r, errUrl, http.StatusSeeOther)
+			return
+		}
+
 		// TODO: re-enable domain login
 		//domain, err := db.GetDomain(r.Host)
 		//if err != nil {
@@ -156,6 +146,7 @@ func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jo
 			Claim("scope", r.Form.Get("scope")).
 			Claim("nonce", r.Form.Get("nonce")).
 			Claim("pkce_code_challenge", r.Form.Get("code_challenge")).
+			Claim("pkce_code_challenge_method", ar.CodeChallengeMethod).
 			Claim("response_type", ar.ResponseType).
 			Build()
 		if err != nil {
@@ -255,6 +246,7 @@ func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jo
 			Claim("domain", r.Host).
 			Claim("id", id).
 			Claim("pkce_code_challenge", claimFromToken("pkce_code_challenge", parsedAuthReq)).
+			Claim("pkce_code_challenge_method", claimFromToken("pkce_code_challenge_method", parsedAuthReq)).
 			Build()
 		if err != nil {
 			w.WriteHeader(500)
@@ -280,11 +272,19 @@ func NewIndieAuthHandler(db Database, tmpl *template.Template, prefix string, jo
 		http.Redirect(w, r, uri, 302)
 	})
 
-	mux.HandleFunc("/token", handleToken)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if handleCorsPreflight(w, r, config.CorsAllowedOrigins, "POST, OPTIONS") {
+			return
+		}
+
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
+
+		handleToken(w, r)
+	})
 
 	mux.HandleFunc("/.well-known/oauth-authorization-server", func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
 		rootUri := domainToUri(r.Host)
@@ -0,0 +1,40 @@
+package obligator
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestIndieAuthHandler(t *testing.T, db Database, jose *JOSE) *IndieAuthHandler {
+	tmpl, err := template.ParseFS(fs, "templates/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewIndieAuthHandler(db, ServerConfig{}, tmpl, "", jose)
+}
+
+func TestIndieAuthRejectsFormPost(t *testing.T) {
+	db := newTestDatabase(t)
+	h := newTestIndieAuthHandler(t, db, newTestJOSE(t, db))
+
+	r := newTestAuthRequest("https://app.example.com", "https://app.example.com/callback")
+	query := r.URL.Query()
+	query.Set("response_mode", "form_post")
+	r.URL.RawQuery = query.Encode()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d", w.Code)
+	}
+
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "https://app.example.com/callback?error=invalid_request") {
+		t.Fatalf("expected invalid_request redirect, got %q", location)
+	}
+}
@@ -1,10 +1,12 @@
 package obligator
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"sync"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwe"
@@ -32,8 +34,8 @@ func NewJWT() jwt.Token {
 }
 
 type JOSE struct {
-	db   Database
-	jwks jwk.Set
+	db      Database
+	cluster *Cluster
 }
 
 func NewJOSE(db Database, cluster *Cluster) (*JOSE, error) {
@@ -66,10 +68,16 @@ func NewJOSE(db Database, cluster *Cluster) (*JOSE, error) {
 			return nil, err
 		}
 
+		key, _ := jwks.Key(0)
+		err = db.SetSigningKeyId(key.KeyID())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	j := &JOSE{
-		db: db,
+		db:      db,
+		cluster: cluster,
 	}
 
 	return j, nil
@@ -79,13 +87,7 @@ func (j *JOSE) GetJWKS() (jwk.Set, error) {
 	return GetJWKS(j.db)
 }
 func GetJWKS(db Database) (jwk.Set, error) {
-
-	jwksJson, err := db.GetJwksJson()
-	if err != nil {
-		return nil, err
-	}
-
-	jwks, err := jwk.Parse([]byte(jwksJson))
+	jwks, _, err := loadJwks(db)
 	if err != nil {
 		return nil, err
 	}
@@ -97,18 +99,72 @@ func (j *JOSE) GetPublicJwks() (jwk.Set, error) {
 	return getPublicJwks(j.db)
 }
 func getPublicJwks(db Database) (jwk.Set, error) {
-
-	jwks, err := GetJWKS(db)
+	_, publicJwks, err := loadJwks(db)
 	if err != nil {
 		return nil, err
 	}
 
+	return publicJwks, nil
+}
+
+// Parsing the JWKS and deriving the public set is expensive, and it happens
+// on every validation request. The parsed sets are cached per database, keyed
+// by the JSON stored in it, so a key change on any node invalidates the cache.
+//
+// This still costs a database read and a comparison of the full JWKS JSON on
+// every lookup. That's deliberate: replicas don't get notified when the primary
+// changes keys, so reading the stored JSON is how they notice.
+type jwksCache struct {
+	mut        sync.RWMutex
+	jwksJson   string
+	jwks       jwk.Set
+	publicJwks jwk.Set
+}
+
+var jwksCaches sync.Map
+
+func getJwksCache(db Database) *jwksCache {
+	cache, exists := jwksCaches.Load(db)
+	if !exists {
+		cache, _ = jwksCaches.LoadOrStore(db, &jwksCache{})
+	}
+	return cache.(*jwksCache)
+}
+
+func loadJwks(db Database) (jwk.Set, jwk.Set, error) {
+
+	jwksJson, err := db.GetJwksJson()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cachedJwks := getJwksCache(db)
+
+	cachedJwks.mut.RLock()
+	if cachedJwks.jwks != nil && cachedJwks.jwksJson == jwksJson {
+		jwks, publicJwks := cachedJwks.jwks, cachedJwks.publicJwks
+		cachedJwks.mut.RUnlock()
+		return jwks, publicJwks, nil
+	}
+	cachedJwks.mut.RUnlock()
+
+	jwks, err := jwk.Parse([]byte(jwksJson))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	publicJwks, err := jwk.PublicSetOf(jwks)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return publicJwks, nil
+	cachedJwks.mut.Lock()
+	cachedJwks.jwksJson = jwksJson
+	cachedJwks.jwks = jwks
+	cachedJwks.publicJwks = publicJwks
+	cachedJwks.mut.Unlock()
+
+	return jwks, publicJwks, nil
 }
 
 func (j *JOSE) SignAndEncrypt(jwt_ jwt.Token) (string, error) {
@@ -123,46 +179,131 @@ func (j *JOSE) Decrypt(encryptedJwt string) (string, error) {
 	return DecryptJWT(j.db, encryptedJwt)
 }
 
-func DecryptJWT(db Database, encryptedJwt string) (string, error) {
-	jwks, err := GetJWKS(db)
+// Rotation writes to the database, so it has to happen on the primary. It's
+// only triggered through the API socket, which can't be forwarded like HTTP
+// requests, so replicas return an error instead.
+func (j *JOSE) RotateSigningKey() error {
+	if !j.cluster.IAmThePrimary() {
+		return errors.New("Signing key rotation must run on the primary")
+	}
+	return rotateSigningKey(j.db)
+}
+
+// Returns the private and public halves of the key currently used for
+// signing. Databases created before key rotation existed don't have a
+// signing key ID, so they fall back to the first key.
+func getSigningKey(db Database) (jwk.Key, jwk.Key, error) {
+
+	// Rotation stores the new JWKS before the new kid, so reading the kid
+	// first guarantees the JWKS loaded after it contains that key.
+	kid, err := db.GetSigningKeyId()
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	jwks, publicJwks, err := loadJwks(db)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	privKey, exists := jwks.Key(0)
+	var privKey, pubKey jwk.Key
+	var exists bool
+	if kid == "" {
+		privKey, exists = jwks.Key(0)
+	} else {
+		privKey, exists = jwks.LookupKeyID(kid)
+	}
 	if !exists {
-		return "", errors.New("JOSE.sign(): No keys available for signing")
+		return nil, nil, errors.New("JOSE.sign(): No keys available for signing")
 	}
 
-	encryptedJwtBytes := []byte(encryptedJwt)
-	decryptedJwt, err := jwe.Decrypt(encryptedJwtBytes, jwe.WithKey(jwa.RSA_OAEP_256, privKey))
-	if err != nil {
-		return "", err
+	pubKey, exists = publicJwks.LookupKeyID(privKey.KeyID())
+	if !exists {
+		return nil, nil, errors.New("JOSE.sign(): no pubkey")
 	}
 
-	return string(decryptedJwt), nil
+	return privKey, pubKey, nil
 }
 
-func SignAndEncryptJWT(db Database, jwt_ jwt.Token) (string, error) {
+var rotateMut sync.Mutex
+
+// Adds a new key to the JWKS and makes it the signing key. Previous keys are
+// kept so tokens they signed can still be verified.
+func rotateSigningKey(db Database) error {
+
+	rotateMut.Lock()
+	defer rotateMut.Unlock()
+
+	jwksJson, err := db.GetJwksJson()
+	if err != nil {
+		return err
+	}
+
+	// Parse a fresh copy rather than modifying the cached set
+	jwks, err := jwk.Parse([]byte(jwksJson))
+	if err != nil {
+		return err
+	}
 
+	key, err := generateJWK()
+	if err != nil {
+		return err
+	}
+
+	err = jwks.AddKey(key)
+	if err != nil {
+		return err
+	}
+
+	newJwksJson, err := json.Marshal(jwks)
+	if err != nil {
+		return err
+	}
+
+	// Store the key before switching to it, so there's never a signing key
+	// ID that isn't in the JWKS
+	err = db.SetJwksJson(string(newJwksJson))
+	if err != nil {
+		return err
+	}
+
+	err = db.SetSigningKeyId(key.KeyID())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func DecryptJWT(db Database, encryptedJwt string) (string, error) {
 	jwks, err := GetJWKS(db)
 	if err != nil {
 		return "", err
 	}
 
-	privKey, exists := jwks.Key(0)
-	if !exists {
-		return "", errors.New("JOSE.sign(): No keys available for signing")
-	}
+	keyProvider := jwe.KeyProviderFunc(func(_ context.Context, sink jwe.KeySink, r jwe.Recipient, _ *jwe.Message) error {
+		privKey, exists := jwks.LookupKeyID(r.Headers().KeyID())
+		if !exists {
+			return errors.New("JOSE.decrypt(): No matching key for decryption")
+		}
+		sink.Key(jwa.RSA_OAEP_256, privKey)
+		return nil
+	})
 
-	publicJwks, err := jwk.PublicSetOf(jwks)
+	encryptedJwtBytes := []byte(encryptedJwt)
+	decryptedJwt, err := jwe.Decrypt(encryptedJwtBytes, jwe.WithKeyProvider(keyProvider))
 	if err != nil {
 		return "", err
 	}
 
-	pubKey, exists := publicJwks.Key(0)
-	if !exists {
-		return "", errors.New("JOSE.sign(): no pubkey")
+	return string(decryptedJwt), nil
+}
+
+func SignAndEncryptJWT(db Database, jwt_ jwt.Token) (string, error) {
+
+	privKey, pubKey, err := getSigningKey(db)
+	if err != nil {
+		return "", err
 	}
 
 	encryptedJwt, err := NewJWTSerializer().
@@ -178,17 +319,15 @@ func SignAndEncryptJWT(db Database, jwt_ jwt.Token) (string, error) {
 
 func SignJWT(db Database, jwt_ jwt.Token) (string, error) {
 
-	jwks, err := GetJWKS(db)
+	key, _, err := getSigningKey(db)
 	if err != nil {
 		return "", err
 	}
 
-	key, exists := jwks.Key(0)
-	if !exists {
-		return "", errors.New("JOSE.sign(): No keys available for signing")
-	}
-
 	signed, err := jwt.Sign(jwt_, jwt.WithKey(jwa.RS256, key))
+	if err != nil {
+		return "", err
+	}
 
 	return string(signed), nil
 }
@@ -198,6 +337,17 @@ func (j *JOSE) Parse(jwtStr string) (jwt.Token, error) {
 }
 
 func GenerateJWKS() (jwk.Set, error) {
+	key, err := generateJWK()
+	if err != nil {
+		return nil, err
+	}
+
+	keyset := jwk.NewSet()
+	keyset.AddKey(key)
+	return keyset, nil
+}
+
+func generateJWK() (jwk.Key, error) {
 	raw, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, err
@@ -219,9 +369,7 @@ func GenerateJWKS() (jwk.Set, error) {
 
 	key.Set("alg", "RS256")
 
-	keyset := jwk.NewSet()
-	keyset.AddKey(key)
-	return keyset, nil
+	return key, nil
 }
 
 func ParseJWT(db Database, jwtStr string) (jwt.Token, error) {
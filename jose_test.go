@@ -0,0 +1,237 @@
+package obligator
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+func newTestDatabase(t testing.TB) Database {
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to :memory: gets its own database
+	sqlDb.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		sqlDb.Close()
+	})
+
+	db, err := NewSqliteDatabaseWithDb(sqlDb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func newTestJOSE(t testing.TB, db Database) *JOSE {
+	jose, err := NewJOSE(db, NewCluster())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose
+}
+
+func signTestJWT(t testing.TB, jose *JOSE) string {
+	tok, err := NewJWTBuilder().Subject("user@example.com").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := jose.Sign(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestJwksCachePerDatabase(t *testing.T) {
+	joseA := newTestJOSE(t, newTestDatabase(t))
+	joseB := newTestJOSE(t, newTestDatabase(t))
+
+	signedA := signTestJWT(t, joseA)
+	signedB := signTestJWT(t, joseB)
+
+	_, err := joseA.Parse(signedA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = joseB.Parse(signedB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = joseA.Parse(signedB)
+	if err == nil {
+		t.Fatal("token signed by another database's key was accepted")
+	}
+}
+
+func TestJwksCacheInvalidatedOnRotate(t *testing.T) {
+	db := newTestDatabase(t)
+	jose := newTestJOSE(t, db)
+
+	oldSigned := signTestJWT(t, jose)
+
+	err := jose.RotateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicJwks, err := jose.GetPublicJwks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if publicJwks.Len() != 2 {
+		t.Fatalf("expected 2 public keys, got %d", publicJwks.Len())
+	}
+
+	_, err = jose.Parse(oldSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jose.Parse(signTestJWT(t, jose))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignDuringRotation(t *testing.T) {
+	db := newTestDatabase(t)
+	jose := newTestJOSE(t, db)
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			err := jose.RotateSigningKey()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				tok, err := NewJWTBuilder().Subject("user@example.com").Build()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				signed, err := jose.Sign(tok)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				_, err = jose.Parse(signed)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func BenchmarkParseJWT(b *testing.B) {
+	db := newTestDatabase(b)
+	jose := newTestJOSE(b, db)
+	signed := signTestJWT(b, jose)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ParseJWT(db, signed)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// What ParseJWT did before the JWKS was cached, for comparison with
+// BenchmarkParseJWT.
+func BenchmarkParseJWTUncached(b *testing.B) {
+	db := newTestDatabase(b)
+	jose := newTestJOSE(b, db)
+	signed := signTestJWT(b, jose)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jwksJson, err := db.GetJwksJson()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		jwks, err := jwk.Parse([]byte(jwksJson))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		publicJwks, err := jwk.PublicSetOf(jwks)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = jwt.Parse([]byte(signed), jwt.WithKeySet(publicJwks))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	db := newTestDatabase(b)
+	jose := newTestJOSE(b, db)
+
+	loginCookie, err := addIdentToCookie("example.com", db, "", &Identity{
+		IdType: IdentityTypeEmail,
+		Id:     "user@example.com",
+	}, jose)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/validate", nil)
+	r.AddCookie(loginCookie)
+	r.AddCookie(&http.Cookie{Name: "obligator_not_cross_site", Value: "true"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := validate(db, r, jose)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -61,6 +61,9 @@ type ServerConfig struct {
 	LogoPng                []byte
 	DisableQrLogin         bool
 	JwksJson               string
+	CorsAllowedOrigins     []string          `json:"cors_allowed_origins"`
+	EventWebhookURL        string            `json:"event_webhook_url"`
+	PersistDynamicClients  bool              `json:"persist_dynamic_clients"`
 	OAuth2Providers        []*OAuth2Provider `json:"oauth2_providers"`
 	Smtp                   *SmtpConfig       `json:"smtp"`
 }
@@ -329,15 +332,15 @@ func NewServer(conf ServerConfig) *Server {
 		os.Exit(1)
 	}
 
-	api, err := NewApi(db, conf.ApiSocketDir, oauth2MetaMan)
+	jose, err := NewJOSE(db, cluster)
+	checkErr(err)
+
+	api, err := NewApi(db, conf.ApiSocketDir, oauth2MetaMan, jose)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
-	jose, err := NewJOSE(db, cluster)
-	checkErr(err)
-
 	tmpl, err := template.ParseFS(fs, "templates/*")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -355,10 +358,12 @@ func NewServer(conf ServerConfig) *Server {
 		}
 	}
 
+	eventWebhook := NewEventWebhook(conf.EventWebhookURL)
+
 	handler := NewHandler(db, conf, tmpl, jose)
 	mux.Handle("/", handler)
 
-	oidcHandler := NewOIDCHandler(db, conf, tmpl, jose)
+	oidcHandler := NewOIDCHandler(db, cluster, conf, tmpl, jose, eventWebhook)
 	mux.Handle("/.well-known/openid-configuration", oidcHandler)
 	mux.Handle("/jwks", oidcHandler)
 	mux.Handle("/register", oidcHandler)
@@ -368,7 +373,7 @@ func NewServer(conf ServerConfig) *Server {
 	mux.Handle("/token", oidcHandler)
 	mux.Handle("/end-session", oidcHandler)
 
-	addIdentityOauth2Handler := NewAddIdentityOauth2Handler(db, oauth2MetaMan, jose)
+	addIdentityOauth2Handler := NewAddIdentityOauth2Handler(db, oauth2MetaMan, conf.BehindProxy, jose, eventWebhook)
 	mux.Handle("/login-oauth2", addIdentityOauth2Handler)
 	mux.Handle("/callback", addIdentityOauth2Handler)
 
@@ -391,7 +396,7 @@ func NewServer(conf ServerConfig) *Server {
 	mux.Handle("/receive", qrHandler)
 
 	indieAuthPrefix := "/indieauth"
-	indieAuthHandler := NewIndieAuthHandler(db, tmpl, indieAuthPrefix, jose)
+	indieAuthHandler := NewIndieAuthHandler(db, conf, tmpl, indieAuthPrefix, jose)
 	mux.Handle("/users/", indieAuthHandler)
 	mux.Handle("/.well-known/oauth-authorization-server", indieAuthHandler)
 	mux.Handle(indieAuthPrefix+"/", http.StripPrefix(indieAuthPrefix, indieAuthHandler))
@@ -475,6 +480,22 @@ func (s *Server) GetUsers() ([]*User, error) {
 	return s.api.GetUsers()
 }
 
+func (s *Server) GetOAuth2Clients() ([]*OAuth2Client, error) {
+	return s.api.GetOAuth2Clients()
+}
+
+func (s *Server) SetOAuth2Client(client OAuth2Client) error {
+	return s.api.SetOAuth2Client(&client)
+}
+
+func (s *Server) DeleteOAuth2Client(clientId string) error {
+	return s.api.DeleteOAuth2Client(clientId)
+}
+
+func (s *Server) RotateSigningKey() error {
+	return s.jose.RotateSigningKey()
+}
+
 func (s *Server) Validate(r *http.Request) (*Validation, error) {
 	return validate(s.db, r, s.jose)
 }
@@ -1,6 +1,8 @@
 package obligator
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -22,6 +24,7 @@ type OAuth2ServerMetadata struct {
 	JwksUri                           string   `json:"jwks_uri,omitempty"`
 	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
 	ResponseTypesSupported            []string `json:"response_types_supported,omitempty"`
+	ResponseModesSupported            []string `json:"response_modes_supported,omitempty"`
 	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported,omitempty"`
 	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
 	SubjectTypesSupported             []string `json:"subject_types_supported"`
@@ -32,12 +35,14 @@ type OAuth2ServerMetadata struct {
 }
 
 type OAuth2AuthRequest struct {
-	ClientId      string `json:"client_id"`
-	RedirectUri   string `json:"redirect_uri"`
-	Scope         string `json:"scope"`
-	State         string `json:"state"`
-	ResponseType  string `json:"response_type"`
-	CodeChallenge string `json:"code_challenge"`
+	ClientId            string `json:"client_id"`
+	RedirectUri         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	ResponseType        string `json:"response_type"`
+	ResponseMode        string `json:"response_mode"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
 }
 
 type OIDCHandler struct {
@@ -54,7 +59,7 @@ type OIDCRegistrationRequest struct {
 	RedirectUris []string `json:"redirect_uris"`
 }
 
-func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, jose *JOSE) *OIDCHandler {
+func NewOIDCHandler(db Database, cluster *Cluster, config ServerConfig, tmpl *template.Template, jose *JOSE, eventWebhook *EventWebhook) *OIDCHandler {
 	mux := http.NewServeMux()
 
 	h := &OIDCHandler{
@@ -69,7 +74,7 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 	// draft-ietf-oauth-security-topics-24 2.6
 	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
 		uri := fmt.Sprintf("https://%s", r.Host)
@@ -82,9 +87,10 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			JwksUri:                          fmt.Sprintf("%s/jwks", uri),
 			ScopesSupported:                  []string{"openid", "email", "profile"},
 			ResponseTypesSupported:           []string{"code"},
+			ResponseModesSupported:           []string{"query", "form_post"},
 			IdTokenSigningAlgValuesSupported: []string{"RS256"},
 			// draft-ietf-oauth-security-topics-24 2.1.1
-			CodeChallengeMethodsSupported: []string{"S256"},
+			CodeChallengeMethodsSupported: []string{"S256", "plain"},
 			// https://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
 			SubjectTypesSupported:             []string{"public"},
 			RegistrationEndpoint:              fmt.Sprintf("%s/register", uri),
@@ -127,7 +133,7 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 
 	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
 		w.Header().Set("Content-Type", "application/json")
 
 		publicJwks, err := jose.GetPublicJwks()
@@ -164,7 +170,72 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			return
 		}
 
-		clientId := fmt.Sprintf("https://%s", parsedClientIdUrl.Host)
+		clientId := clientIdForHost(parsedClientIdUrl.Host)
+
+		for _, redirectUri := range regReq.RedirectUris {
+			parsedRedirectUri, err := url.Parse(redirectUri)
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			if parsedRedirectUri.Host == "" {
+				w.WriteHeader(400)
+				io.WriteString(w, "redirect_uris must be absolute URIs with a host")
+				return
+			}
+
+			if clientIdForHost(parsedRedirectUri.Host) != clientId {
+				w.WriteHeader(400)
+				io.WriteString(w, "All redirect_uris must be on the same domain")
+				return
+			}
+		}
+
+		// Registration is unauthenticated, so storing redirect_uris lets the
+		// first caller lock the domain to them. That's opt-in. Once a client
+		// is stored its redirect_uris can't be changed here. Re-registering
+		// with URIs that are already registered returns the same client_id.
+		// Admins can delete or replace clients through the API.
+		if config.PersistDynamicClients {
+			client, err := db.GetOAuth2Client(clientId)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			if client != nil {
+				for _, redirectUri := range regReq.RedirectUris {
+					if !containsString(client.RedirectUris, redirectUri) {
+						w.WriteHeader(400)
+						io.WriteString(w, "Client already registered with different redirect_uris")
+						return
+					}
+				}
+			} else {
+				primaryHost, err := cluster.PrimaryHost()
+				if err != nil {
+					// I *am* the primary
+				} else {
+					done := cluster.RedirectOrForward(primaryHost, w, r)
+					if done {
+						return
+					}
+				}
+
+				err = db.SetOAuth2Client(&OAuth2Client{
+					ClientId:     clientId,
+					RedirectUris: regReq.RedirectUris,
+				})
+				if err != nil {
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+			}
+		}
 
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 		w.WriteHeader(201)
@@ -179,6 +250,12 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 	})
 
 	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if handleCorsPreflight(w, r, config.CorsAllowedOrigins, "GET, POST, OPTIONS") {
+			return
+		}
+
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
+
 		authHeader := r.Header.Get("Authorization")
 		parts := strings.Split(authHeader, " ")
 
@@ -213,7 +290,7 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 
 		r.ParseForm()
 
-		ar, err := ParseAuthRequest(w, r)
+		ar, err := ParseAuthRequest(db, w, r)
 		if err != nil {
 			return
 		}
@@ -265,7 +342,9 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			Claim("scope", r.Form.Get("scope")).
 			Claim("nonce", r.Form.Get("nonce")).
 			Claim("pkce_code_challenge", r.Form.Get("code_challenge")).
+			Claim("pkce_code_challenge_method", ar.CodeChallengeMethod).
 			Claim("response_type", ar.ResponseType).
+			Claim("response_mode", ar.ResponseMode).
 			Claim("flow_type", flowType).
 			Build()
 		if err != nil {
@@ -461,6 +540,7 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			Subject(idToken.Email()).
 			Claim("id_token", signedAndEncryptedIdToken).
 			Claim("pkce_code_challenge", claimFromToken("pkce_code_challenge", parsedAuthReq)).
+			Claim("pkce_code_challenge_method", claimFromToken("pkce_code_challenge_method", parsedAuthReq)).
 			Build()
 		if err != nil {
 			w.WriteHeader(500)
@@ -475,12 +555,46 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			return
 		}
 
+		loginEvent := &LoginEvent{
+			Type:         EventTypeLogin,
+			Subject:      expandedId,
+			Email:        expandedId,
+			ClientId:     clientId,
+			ProviderName: identity.ProviderName,
+			Timestamp:    issuedAt.Format(time.RFC3339),
+			RemoteIp:     getEventRemoteIp(r, config.BehindProxy),
+		}
+
 		responseType := claimFromToken("response_type", parsedAuthReq)
 
 		// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#none
 		if responseType == "none" {
 			redirectUri := claimFromToken("redirect_uri", parsedAuthReq)
 			http.Redirect(w, r, redirectUri, http.StatusSeeOther)
+		} else if claimFromToken("response_mode", parsedAuthReq) == "form_post" {
+			data := struct {
+				*commonData
+				RedirectUri string
+				Code        string
+				State       string
+			}{
+				commonData:  newCommonData(nil, db, r),
+				RedirectUri: claimFromToken("redirect_uri", parsedAuthReq),
+				Code:        string(signedCode),
+				State:       claimFromToken("state", parsedAuthReq),
+			}
+
+			// Render to a buffer so a template error can still return a 500
+			var buf bytes.Buffer
+			err = tmpl.ExecuteTemplate(&buf, "form-post.html", data)
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			w.Header().Set("Cache-Control", "no-store")
+			buf.WriteTo(w)
 		} else {
 			url := fmt.Sprintf("%s?client_id=%s&redirect_uri=%s&code=%s&state=%s&scope=%s",
 				claimFromToken("redirect_uri", parsedAuthReq),
@@ -492,10 +606,18 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 
 			http.Redirect(w, r, url, http.StatusSeeOther)
 		}
+
+		eventWebhook.SendLoginEvent(loginEvent)
 	})
 
 	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
 
+		if handleCorsPreflight(w, r, config.CorsAllowedOrigins, "POST, OPTIONS") {
+			return
+		}
+
+		setCorsHeaders(w, r, config.CorsAllowedOrigins)
+
 		r.ParseForm()
 
 		codeJwt := r.Form.Get("code")
@@ -530,31 +652,13 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			return
 		}
 
-		pkceCodeChallenge, exists := parsedCodeJwt.Get("pkce_code_challenge")
-		if !exists {
-			w.WriteHeader(401)
-			io.WriteString(w, "Invalid pkce_code_challenge in code")
+		status, msg := verifyPKCE(parsedCodeJwt, r)
+		if status != 0 {
+			w.WriteHeader(status)
+			io.WriteString(w, msg)
 			return
 		}
 
-		// https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#section-4.8.2
-		// draft-ietf-oauth-security-topics-24 2.1.1
-		pkceCodeVerifier := r.Form.Get("code_verifier")
-		if pkceCodeChallenge != "" {
-			challenge := GeneratePKCECodeChallenge(pkceCodeVerifier)
-			if challenge != pkceCodeChallenge {
-				w.WriteHeader(401)
-				io.WriteString(w, "Invalid code_verifier")
-				return
-			}
-		} else {
-			if pkceCodeVerifier != "" {
-				w.WriteHeader(401)
-				io.WriteString(w, "code_verifier provided for request that did not include code_challenge")
-				return
-			}
-		}
-
 		issuedAt := time.Now().UTC()
 		accessTokenJwt, err := NewJWTBuilder().
 			IssuedAt(issuedAt).
@@ -574,7 +678,6 @@ func NewOIDCHandler(db Database, config ServerConfig, tmpl *template.Template, j
 			return
 		}
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 		w.Header().Set("Cache-Control", "no-store")
 
@@ -626,7 +729,7 @@ func (h *OIDCHandler) handleWildcardEmail(w http.ResponseWriter, r *http.Request
 	return emailWildcard, false
 }
 
-func ParseAuthRequest(w http.ResponseWriter, r *http.Request) (*OAuth2AuthRequest, error) {
+func ParseAuthRequest(db Database, w http.ResponseWriter, r *http.Request) (*OAuth2AuthRequest, error) {
 	r.ParseForm()
 
 	clientId := r.Form.Get("client_id")
@@ -660,7 +763,22 @@ func ParseAuthRequest(w http.ResponseWriter, r *http.Request) (*OAuth2AuthReques
 	}
 
 	// draft-ietf-oauth-security-topics-24 4.1
-	if parsedClientIdUri.Host != parsedRedirectUri.Host {
+	// Registrations are looked up by host, so variations of client_id like
+	// a trailing slash or different scheme can't skip the exact match.
+	client, err := db.GetOAuth2Client(clientIdForHost(parsedClientIdUri.Host))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return nil, err
+	}
+
+	if client != nil {
+		if !containsString(client.RedirectUris, redirectUri) {
+			w.WriteHeader(400)
+			io.WriteString(w, "redirect_uri is not registered for client_id")
+			return nil, errors.New("redirect_uri is not registered for client_id")
+		}
+	} else if parsedClientIdUri.Host != parsedRedirectUri.Host {
 		w.WriteHeader(400)
 		io.WriteString(w, "redirect_uri must be on the same domain as client_id")
 		fmt.Println(redirectUri, clientId)
@@ -670,6 +788,9 @@ func ParseAuthRequest(w http.ResponseWriter, r *http.Request) (*OAuth2AuthReques
 	scope := r.Form.Get("scope")
 	state := r.Form.Get("state")
 
+	// Error responses below are always sent as query parameters, even if
+	// response_mode=form_post was requested. This is deliberate: they carry
+	// no code, and response_mode itself may be the invalid parameter.
 	promptParam := r.Form.Get("prompt")
 	if promptParam == "none" {
 		errUrl := fmt.Sprintf("%s?error=interaction_required&state=%s",
@@ -686,18 +807,94 @@ func ParseAuthRequest(w http.ResponseWriter, r *http.Request) (*OAuth2AuthReques
 		return nil, errors.New("unsupported_response_type")
 	}
 
+	responseMode := r.Form.Get("response_mode")
+	if responseMode == "" {
+		responseMode = "query"
+	}
+
+	if responseMode != "query" && responseMode != "form_post" {
+		errUrl := fmt.Sprintf("%s?error=invalid_request&state=%s",
+			redirectUri, state)
+		http.Redirect(w, r, errUrl, http.StatusSeeOther)
+		return nil, errors.New("unsupported response_mode")
+	}
+
 	pkceCodeChallenge := r.Form.Get("code_challenge")
 
+	// RFC 7636 defaults to plain, but obligator has always assumed S256 when
+	// the method is omitted, so keep that to avoid weakening existing clients.
+	pkceCodeChallengeMethod := r.Form.Get("code_challenge_method")
+	if pkceCodeChallenge != "" && pkceCodeChallengeMethod == "" {
+		pkceCodeChallengeMethod = "S256"
+	}
+
+	if pkceCodeChallengeMethod != "" && pkceCodeChallengeMethod != "S256" && pkceCodeChallengeMethod != "plain" {
+		errUrl := fmt.Sprintf("%s?error=invalid_request&state=%s",
+			redirectUri, state)
+		http.Redirect(w, r, errUrl, http.StatusSeeOther)
+		return nil, errors.New("unsupported code_challenge_method")
+	}
+
+	if pkceCodeChallenge != "" && !ValidPKCECodeChallenge(pkceCodeChallenge) {
+		errUrl := fmt.Sprintf("%s?error=invalid_request&state=%s",
+			redirectUri, state)
+		http.Redirect(w, r, errUrl, http.StatusSeeOther)
+		return nil, errors.New("invalid code_challenge")
+	}
+
 	return &OAuth2AuthRequest{
-		ClientId:      clientId,
-		RedirectUri:   redirectUri,
-		ResponseType:  responseType,
-		Scope:         scope,
-		State:         state,
-		CodeChallenge: pkceCodeChallenge,
+		ClientId:            clientId,
+		RedirectUri:         redirectUri,
+		ResponseType:        responseType,
+		ResponseMode:        responseMode,
+		Scope:               scope,
+		State:               state,
+		CodeChallenge:       pkceCodeChallenge,
+		CodeChallengeMethod: pkceCodeChallengeMethod,
 	}, nil
 }
 
+// Checks the token request's code_verifier against the PKCE challenge recorded
+// in the code. Returns a zero status if the request may proceed.
+func verifyPKCE(parsedCodeJwt JWTToken, r *http.Request) (int, string) {
+
+	if _, exists := parsedCodeJwt.Get("pkce_code_challenge"); !exists {
+		return 401, "Invalid pkce_code_challenge in code"
+	}
+
+	// https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#section-4.8.2
+	// draft-ietf-oauth-security-topics-24 2.1.1
+	pkceCodeChallenge := claimFromToken("pkce_code_challenge", parsedCodeJwt)
+	pkceCodeVerifier := r.Form.Get("code_verifier")
+	if pkceCodeChallenge == "" {
+		if pkceCodeVerifier != "" {
+			return 401, "code_verifier provided for request that did not include code_challenge"
+		}
+		return 0, ""
+	}
+
+	// The method comes from the signed code, so clients can't downgrade
+	// from S256 to plain. It's not a token request parameter, but reject
+	// clients that claim a different one.
+	pkceCodeChallengeMethod := claimFromToken("pkce_code_challenge_method", parsedCodeJwt)
+	requestedMethod := r.Form.Get("code_challenge_method")
+	if requestedMethod != "" && requestedMethod != pkceCodeChallengeMethod {
+		return 401, "code_challenge_method does not match authorization request"
+	}
+
+	if !VerifyPKCECodeVerifier(pkceCodeChallenge, pkceCodeChallengeMethod, pkceCodeVerifier) {
+		return 401, "Invalid code_verifier"
+	}
+
+	return 0, ""
+}
+
+// Registered clients are stored under a client_id derived from the host of
+// their redirect_uris
+func clientIdForHost(host string) string {
+	return domainToUri(strings.ToLower(host))
+}
+
 func (h *OIDCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
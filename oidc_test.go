@@ -0,0 +1,544 @@
+package obligator
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthRequest(clientId, redirectUri string) *http.Request {
+	params := url.Values{}
+	params.Set("client_id", clientId)
+	params.Set("redirect_uri", redirectUri)
+	params.Set("response_type", "code")
+	params.Set("state", "abc")
+	return httptest.NewRequest(http.MethodGet, "https://auth.example.com/auth?"+params.Encode(), nil)
+}
+
+func registerTestClient(t *testing.T, db Database, redirectUris ...string) {
+	err := db.SetOAuth2Client(&OAuth2Client{
+		ClientId:     "https://app.example.com",
+		RedirectUris: redirectUris,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseAuthRequestRedirectUri(t *testing.T) {
+	db := newTestDatabase(t)
+	registerTestClient(t, db, "https://app.example.com/callback")
+
+	tests := []struct {
+		name        string
+		clientId    string
+		redirectUri string
+		valid       bool
+	}{
+		{"registered exact match", "https://app.example.com", "https://app.example.com/callback", true},
+		{"registered same host different path", "https://app.example.com", "https://app.example.com/evil", false},
+		{"registered with trailing slash client_id", "https://app.example.com/", "https://app.example.com/evil", false},
+		{"registered with http client_id", "http://app.example.com", "https://app.example.com/evil", false},
+		{"registered with path client_id", "https://app.example.com/x", "https://app.example.com/evil", false},
+		{"registered with uppercase client_id", "https://APP.example.com", "https://APP.example.com/evil", false},
+		{"unregistered same host", "https://other.example.com", "https://other.example.com/any/path", true},
+		{"unregistered different host", "https://other.example.com", "https://evil.example.com/callback", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ar, err := ParseAuthRequest(db, w, newTestAuthRequest(test.clientId, test.redirectUri))
+
+			if test.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ar.RedirectUri != test.redirectUri {
+					t.Fatalf("expected redirect_uri %s, got %s", test.redirectUri, ar.RedirectUri)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("expected redirect_uri to be rejected")
+				}
+				if w.Code != 400 {
+					t.Fatalf("expected status 400, got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAuthRequestDatabaseError(t *testing.T) {
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSqliteDatabaseWithDb(sqlDb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDb.Close()
+
+	w := httptest.NewRecorder()
+	_, err = ParseAuthRequest(db, w, newTestAuthRequest("https://app.example.com", "https://app.example.com/evil"))
+	if err == nil {
+		t.Fatal("expected database error to reject the request")
+	}
+
+	if w.Code != 500 {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+}
+
+func TestApiReplacesRegisteredClient(t *testing.T) {
+	db := newTestDatabase(t)
+	registerTestClient(t, db, "https://app.example.com/squatted")
+
+	api, err := NewApi(db, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.SetOAuth2Client(&OAuth2Client{
+		RedirectUris: []string{"https://app.example.com/callback", "https://evil.example.com/callback"},
+	})
+	if err == nil {
+		t.Fatal("expected redirect_uris on different domains to be rejected")
+	}
+
+	err = api.SetOAuth2Client(&OAuth2Client{
+		RedirectUris: []string{"https://app.example.com/callback"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	_, err = ParseAuthRequest(db, w, newTestAuthRequest("https://app.example.com", "https://app.example.com/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.DeleteOAuth2Client("https://app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := api.GetOAuth2Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 0 {
+		t.Fatalf("expected no clients, got %d", len(clients))
+	}
+}
+
+func TestParseAuthRequestCodeChallenge(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tests := []struct {
+		name           string
+		challenge      string
+		method         string
+		valid          bool
+		expectedMethod string
+	}{
+		{"no challenge", "", "", true, ""},
+		{"method defaults to S256", GeneratePKCECodeChallenge("verifier"), "", true, "S256"},
+		{"plain", strings.Repeat("a", 43), "plain", true, "plain"},
+		{"short plain challenge", "abc", "plain", false, ""},
+		{"unsupported method", strings.Repeat("a", 43), "S512", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestAuthRequest("https://app.example.com", "https://app.example.com/callback")
+			query := r.URL.Query()
+			query.Set("code_challenge", test.challenge)
+			query.Set("code_challenge_method", test.method)
+			r.URL.RawQuery = query.Encode()
+
+			w := httptest.NewRecorder()
+			ar, err := ParseAuthRequest(db, w, r)
+
+			if !test.valid {
+				if err == nil {
+					t.Fatal("expected code_challenge to be rejected")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ar.CodeChallengeMethod != test.expectedMethod {
+				t.Fatalf("expected method %q, got %q", test.expectedMethod, ar.CodeChallengeMethod)
+			}
+		})
+	}
+}
+
+func newTestOIDCHandler(t *testing.T, db Database, jose *JOSE, config ServerConfig) *OIDCHandler {
+	tmpl, err := template.ParseFS(fs, "templates/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewOIDCHandler(db, NewCluster(), config, tmpl, jose, nil)
+}
+
+func addTestLoginCookies(t *testing.T, db Database, jose *JOSE, r *http.Request, ident *Identity) {
+	loginCookie, err := addIdentToCookie("example.com", db, "", ident, jose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(loginCookie)
+	r.AddCookie(&http.Cookie{Name: "obligator_not_cross_site", Value: "true"})
+}
+
+func TestParseAuthRequestResponseMode(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tests := []struct {
+		name         string
+		responseMode string
+		expected     string
+	}{
+		{"defaults to query", "", "query"},
+		{"query", "query", "query"},
+		{"form_post", "form_post", "form_post"},
+		{"invalid", "fragment", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestAuthRequest("https://app.example.com", "https://app.example.com/callback")
+			query := r.URL.Query()
+			query.Set("response_mode", test.responseMode)
+			r.URL.RawQuery = query.Encode()
+
+			w := httptest.NewRecorder()
+			ar, err := ParseAuthRequest(db, w, r)
+
+			if test.expected == "" {
+				if err == nil {
+					t.Fatal("expected response_mode to be rejected")
+				}
+
+				location := w.Header().Get("Location")
+				if !strings.HasPrefix(location, "https://app.example.com/callback?error=invalid_request") {
+					t.Fatalf("expected invalid_request redirect, got %q", location)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ar.ResponseMode != test.expected {
+				t.Fatalf("expected response_mode %q, got %q", test.expected, ar.ResponseMode)
+			}
+		})
+	}
+}
+
+func TestApproveFormPost(t *testing.T) {
+	db := newTestDatabase(t)
+	jose := newTestJOSE(t, db)
+	h := newTestOIDCHandler(t, db, jose, ServerConfig{})
+
+	issuedAt := time.Now().UTC()
+	authReqJwt, err := NewJWTBuilder().
+		IssuedAt(issuedAt).
+		Expiration(issuedAt.Add(time.Minute)).
+		Claim("client_id", "https://app.example.com").
+		Claim("redirect_uri", "https://app.example.com/callback").
+		Claim("state", "abc").
+		Claim("scope", "openid email").
+		Claim("response_type", "code").
+		Claim("response_mode", "form_post").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedAuthReq, err := jose.Sign(authReqJwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/approve?identity_id=user@example.com", nil)
+	r.AddCookie(&http.Cookie{Name: "obligator_auth_request", Value: signedAuthReq})
+	addTestLoginCookies(t, db, jose, r, &Identity{
+		IdType:       IdentityTypeEmail,
+		Id:           "user@example.com",
+		ProviderName: "Email",
+		Email:        "user@example.com",
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if location := w.Header().Get("Location"); location != "" {
+		t.Fatalf("expected no Location header, got %q", location)
+	}
+
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Fatalf("expected Cache-Control no-store, got %q", cacheControl)
+	}
+
+	body := w.Body.String()
+
+	if !strings.Contains(body, `action="https://app.example.com/callback" method="POST"`) {
+		t.Fatal("expected form to POST to redirect_uri")
+	}
+
+	if !strings.Contains(body, "<input type='hidden' name='state' value='abc'>") {
+		t.Fatal("expected hidden state input")
+	}
+
+	match := regexp.MustCompile(`<input type='hidden' name='code' value='([^']+)'>`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("expected hidden code input")
+	}
+
+	_, err = jose.Parse(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func postTestRegistration(t *testing.T, h http.Handler, redirectUris ...string) (*httptest.ResponseRecorder, *OIDCRegistrationResponse) {
+	body, err := json.Marshal(OIDCRegistrationRequest{RedirectUris: redirectUris})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://example.com/register", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 201 {
+		return w, nil
+	}
+
+	var resp OIDCRegistrationResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w, &resp
+}
+
+func TestRegisterPersistsClient(t *testing.T) {
+	db := newTestDatabase(t)
+	h := newTestOIDCHandler(t, db, newTestJOSE(t, db), ServerConfig{PersistDynamicClients: true})
+
+	redirectUris := []string{"https://app.example.com/callback", "https://app.example.com/other"}
+
+	_, resp := postTestRegistration(t, h, redirectUris...)
+	if resp == nil {
+		t.Fatal("registration failed")
+	}
+
+	if resp.ClientId != "https://app.example.com" {
+		t.Fatalf("unexpected client_id %s", resp.ClientId)
+	}
+
+	client, err := db.GetOAuth2Client(resp.ClientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(client.RedirectUris, " ") != strings.Join(redirectUris, " ") {
+		t.Fatalf("expected %v to be stored, got %v", redirectUris, client.RedirectUris)
+	}
+
+	_, resp = postTestRegistration(t, h, "https://app.example.com/other")
+	if resp == nil {
+		t.Fatal("re-registration with registered URIs failed")
+	}
+
+	if resp.ClientId != "https://app.example.com" {
+		t.Fatalf("client_id changed on re-registration: %s", resp.ClientId)
+	}
+
+	w, _ := postTestRegistration(t, h, "https://app.example.com/new")
+	if w.Code != 400 {
+		t.Fatalf("expected re-registration with new URI to return 400, got %d", w.Code)
+	}
+}
+
+func TestRegisterRejectsInvalidRedirectUris(t *testing.T) {
+	db := newTestDatabase(t)
+	h := newTestOIDCHandler(t, db, newTestJOSE(t, db), ServerConfig{PersistDynamicClients: true})
+
+	tests := []struct {
+		name         string
+		redirectUris []string
+	}{
+		{"none", []string{}},
+		{"mixed hosts", []string{"https://app.example.com/callback", "https://evil.example.com/callback"}},
+		{"relative", []string{"/cb"}},
+		{"custom scheme without host", []string{"myapp:cb"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, _ := postTestRegistration(t, h, test.redirectUris...)
+			if w.Code != 400 {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+		})
+	}
+
+	clients, err := db.GetOAuth2Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 0 {
+		t.Fatalf("expected no clients to be stored, got %d", len(clients))
+	}
+}
+
+func TestRegisterDoesNotPersistByDefault(t *testing.T) {
+	db := newTestDatabase(t)
+	h := newTestOIDCHandler(t, db, newTestJOSE(t, db), ServerConfig{})
+
+	_, resp := postTestRegistration(t, h, "https://app.example.com/callback")
+	if resp == nil {
+		t.Fatal("registration failed")
+	}
+
+	if resp.ClientId != "https://app.example.com" {
+		t.Fatalf("unexpected client_id %s", resp.ClientId)
+	}
+
+	clients, err := db.GetOAuth2Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 0 {
+		t.Fatalf("expected no clients to be stored, got %d", len(clients))
+	}
+
+	// Anonymous clients on the domain keep working
+	w := httptest.NewRecorder()
+	_, err = ParseAuthRequest(db, w, newTestAuthRequest("https://app.example.com", "https://app.example.com/any"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Builds a code like /approve and /confirm issue, with an S256 challenge
+// for verifier
+func newTestPKCECode(t *testing.T, jose *JOSE, verifier string) string {
+	idToken, err := NewJWTBuilder().
+		Subject("user@example.com").
+		Claim("email", "user@example.com").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedAndEncryptedIdToken, err := jose.SignAndEncrypt(idToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuedAt := time.Now().UTC()
+	codeJwt, err := NewJWTBuilder().
+		IssuedAt(issuedAt).
+		Expiration(issuedAt.Add(16*time.Second)).
+		Subject("user@example.com").
+		Claim("id_token", signedAndEncryptedIdToken).
+		Claim("domain", "example.com").
+		Claim("id", "user@example.com").
+		Claim("pkce_code_challenge", GeneratePKCECodeChallenge(verifier)).
+		Claim("pkce_code_challenge_method", "S256").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedCode, err := jose.Sign(codeJwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signedCode
+}
+
+func TestTokenRejectsPKCEDowngrade(t *testing.T) {
+	db := newTestDatabase(t)
+	jose := newTestJOSE(t, db)
+
+	verifier, err := GeneratePKCECodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := GeneratePKCECodeChallenge(verifier)
+
+	handlers := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"oidc", newTestOIDCHandler(t, db, jose, ServerConfig{})},
+		{"indieauth", newTestIndieAuthHandler(t, db, jose)},
+	}
+
+	tests := []struct {
+		name     string
+		verifier string
+		method   string
+		status   int
+	}{
+		{"S256", verifier, "", 200},
+		{"challenge as plain verifier", challenge, "plain", 401},
+		{"challenge as verifier", challenge, "", 401},
+	}
+
+	for _, handler := range handlers {
+		for _, test := range tests {
+			t.Run(handler.name+"/"+test.name, func(t *testing.T) {
+				form := url.Values{}
+				form.Set("code", newTestPKCECode(t, jose, verifier))
+				form.Set("code_verifier", test.verifier)
+				if test.method != "" {
+					form.Set("code_challenge_method", test.method)
+				}
+
+				r := httptest.NewRequest(http.MethodPost, "https://example.com/token", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				handler.handler.ServeHTTP(w, r)
+
+				if w.Code != test.status {
+					t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+				}
+			})
+		}
+	}
+}
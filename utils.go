@@ -138,6 +138,46 @@ func validUser(id string, users []*User) bool {
 	return false
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// If no origins are configured, any origin is allowed, but without
+// credentials.
+func setCorsHeaders(w http.ResponseWriter, r *http.Request, allowedOrigins []string) {
+	if len(allowedOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if containsString(allowedOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func handleCorsPreflight(w http.ResponseWriter, r *http.Request, allowedOrigins []string, methods string) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	setCorsHeaders(w, r, allowedOrigins)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(204)
+
+	return true
+}
+
 func getLoginCookie(db Database, r *http.Request) (*http.Cookie, error) {
 
 	prefix, err := db.GetPrefix()
@@ -486,6 +526,16 @@ func getRemoteIp(r *http.Request, behindProxy bool) (string, error) {
 	return remoteIp, nil
 }
 
+// The IP is only informational for events, so errors are logged rather than
+// failing the request.
+func getEventRemoteIp(r *http.Request, behindProxy bool) string {
+	remoteIp, err := getRemoteIp(r, behindProxy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	return remoteIp
+}
+
 // This function doesn't check against cross site requests as compared to
 // the normal version
 func getIdentitiesFedCm(db Database, r *http.Request) ([]*Identity, error) {
@@ -0,0 +1,95 @@
+package obligator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetCorsHeaders(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowedOrigins   []string
+		origin           string
+		allowOrigin      string
+		allowCredentials string
+		vary             string
+	}{
+		{"any origin", nil, "https://app.example.com", "*", "", ""},
+		{"allowed origin", []string{"https://app.example.com"}, "https://app.example.com", "https://app.example.com", "true", "Origin"},
+		{"disallowed origin", []string{"https://app.example.com"}, "https://evil.example.com", "", "", "Origin"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://example.com/token", nil)
+			r.Header.Set("Origin", test.origin)
+			w := httptest.NewRecorder()
+
+			setCorsHeaders(w, r, test.allowedOrigins)
+
+			header := w.Header()
+
+			if header.Get("Access-Control-Allow-Origin") != test.allowOrigin {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", test.allowOrigin, header.Get("Access-Control-Allow-Origin"))
+			}
+
+			if header.Get("Access-Control-Allow-Credentials") != test.allowCredentials {
+				t.Errorf("expected Access-Control-Allow-Credentials %q, got %q", test.allowCredentials, header.Get("Access-Control-Allow-Credentials"))
+			}
+
+			if header.Get("Vary") != test.vary {
+				t.Errorf("expected Vary %q, got %q", test.vary, header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestHandleCorsPreflight(t *testing.T) {
+	allowedOrigins := []string{"https://app.example.com"}
+
+	r := httptest.NewRequest(http.MethodOptions, "https://example.com/token", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+
+	if !handleCorsPreflight(w, r, allowedOrigins, "POST, OPTIONS") {
+		t.Fatal("OPTIONS request not handled")
+	}
+
+	if w.Code != 204 {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	if w.Header().Get("Access-Control-Allow-Methods") != "POST, OPTIONS" {
+		t.Fatalf("unexpected Access-Control-Allow-Methods %q", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "https://example.com/token", nil)
+	w = httptest.NewRecorder()
+
+	if handleCorsPreflight(w, r, allowedOrigins, "POST, OPTIONS") {
+		t.Fatal("POST request handled as preflight")
+	}
+}
+
+func TestIndieAuthTokenPreflight(t *testing.T) {
+	db := newTestDatabase(t)
+	h := newTestIndieAuthHandler(t, db, newTestJOSE(t, db))
+
+	r := httptest.NewRequest(http.MethodOptions, "https://example.com/token", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 204 {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}